@@ -17,9 +17,11 @@ package main
 import (
 	"context"
 	"flag"
+	"sync"
 	"time"
 
 	"github.com/albarbaro/go-pagerduty"
+	"github.com/google/go-github/v48/github"
 	"github.com/prometheus/client_golang/prometheus"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
@@ -29,27 +31,70 @@ import (
 const CLUSTER_NAME string = "local_demo_cluster"
 const APP_LABEL string = "app.kubernetes.io/instance"
 
+// Commit search is retried with a linear backoff on transient errors before giving up and counting a lookup error
+const commitSearchAttempts int = 3
+
+var commitSearchBackoff time.Duration = time.Second
+
+// commitLookupKey identifies the repository a failed commit lookup belongs to
+type commitLookupKey struct {
+	org  string
+	repo string
+}
+
+// CollectorOptions holds the settings used to select the deployments, images and incidents the collector reports on
+type CollectorOptions struct {
+	// SearchLabels are the labels used to find deployments, the first one set on a deployment names its component
+	SearchLabels        []string
+	ImageFilters        []string
+	ImageExcludes       []string
+	PagerdutyServiceIDs []string
+	// ScrapeTimeout bounds the time spent calling github and pagerduty during a single scrape
+	ScrapeTimeout time.Duration
+	// FailureLookback is how far back incident creation and resolution times are ingested at each scrape
+	FailureLookback time.Duration
+	// GithubMinRemainingQuota defers commit searches while the remaining github search quota is below it, 0 disables the check
+	GithubMinRemainingQuota int
+	// GithubMaxRateLimitWait is the longest a commit search waits for a github rate limit to reset before retrying
+	GithubMaxRateLimitWait time.Duration
+}
+
 // Define a struct for you collector that contains pointers to prometheus descriptors for each metric you wish to expose.
 // You can also include fields of other types if they provide utility
 type Collector struct {
+	// mutex serializes the scrapes: promhttp runs overlapping scrapes concurrently and Collect updates the caches and counters below
+	mutex                    sync.Mutex
 	commitTimeMetric         *prometheus.Desc
 	deployTimeMetric         *prometheus.Desc
 	activeDeploymentMetric   *prometheus.Desc
 	inactiveDeploymentMetric *prometheus.Desc
 	failure_creation_time    *prometheus.Desc
 	failure_resolution_time  *prometheus.Desc
-	githubClient             *GithubClient
+	commitLookupErrorsMetric *prometheus.Desc
+	gitCacheHitsMetric       *prometheus.Desc
+	gitCacheMissesMetric     *prometheus.Desc
+	githubRateLimitMetric    *prometheus.Desc
+	githubClient             githubAPI
 	kubeClient               *KubeClients
-	pagerdutyClient          *pagerduty.Client
+	pagerdutyClient          incidentLister
 	commitHashSet            map[string]bool
 	gitCache                 map[string]*time.Time
-	searchLabel              string
+	commitLookupErrors       map[commitLookupKey]float64
+	gitCacheHits             float64
+	gitCacheMisses           float64
+	searchLabels             []string
 	imageFilter              []string
 	imageExcludes            []string
+	pagerdutyServiceIDs      []string
+	scrapeTimeout            time.Duration
+	failureLookback          time.Duration
+	githubMinRemainingQuota  int
+	githubRateLimits         *github.RateLimits
+	githubMaxRateLimitWait   time.Duration
 }
 
 // You must create a constructor for you collector that initializes every descriptor and returns a pointer to the collector
-func NewCommitTimeCollector() (*Collector, error) {
+func NewCommitTimeCollector(opts CollectorOptions) (*Collector, error) {
 	// Initialize the github client
 	gh, err := NewGithubClient()
 	if err != nil {
@@ -62,15 +107,27 @@ func NewCommitTimeCollector() (*Collector, error) {
 		return nil, err
 	}
 
-	pagerdutyClient := NewPagedutyClient()
+	// keep the interface nil, not a nil pointer, when pagerduty is not configured
+	var pagerdutyClient incidentLister
+	if pd := NewPagedutyClient(); pd != nil {
+		pagerdutyClient = pd
+	}
 
-	searchLabel := "app.kubernetes.io/instance"
-	imageFilters := []string{"quay.io/redhat-appstudio/", "quay.io/redhat-appstudio-qe/", "quay.io/stolostrn/", "quay.io/abarbaro/"}
-	imageExcludes := []string{"quay.io/redhat-appstudio/gitopsdepl", "quay.io/redhat-appstudio/user-workload"}
 	flag.Lookup("v").Value.Set("1")
 
-	klog.V(3).Infof("Using label ", searchLabel)
-	klog.V(3).Infof("Using image filters: ", imageFilters)
+	return newCollector(opts, gh, kubeClient, pagerdutyClient), nil
+}
+
+// newCollector builds the collector on top of already initialized clients
+func newCollector(opts CollectorOptions, gh githubAPI, kubeClient *KubeClients, pagerdutyClient incidentLister) *Collector {
+	klog.V(3).Infof("Using labels: %v", opts.SearchLabels)
+	klog.V(3).Infof("Using image filters: %v", opts.ImageFilters)
+	klog.V(3).Infof("Using image excludes: %v", opts.ImageExcludes)
+	klog.V(3).Infof("Using pagerduty services: %v", opts.PagerdutyServiceIDs)
+	klog.V(3).Infof("Using scrape timeout: %s", opts.ScrapeTimeout)
+	klog.V(3).Infof("Using failure lookback: %s", opts.FailureLookback)
+	klog.V(3).Infof("Using github minimum remaining quota: %d", opts.GithubMinRemainingQuota)
+	klog.V(3).Infof("Using github maximum rate limit wait: %s", opts.GithubMaxRateLimitWait)
 
 	return &Collector{
 		commitTimeMetric: prometheus.NewDesc("dora:committime",
@@ -97,25 +154,57 @@ func NewCommitTimeCollector() (*Collector, error) {
 			"Shows the failures creation timestamp in time",
 			[]string{"app", "id"}, nil,
 		),
-		githubClient:    gh,
-		kubeClient:      kubeClient,
-		pagerdutyClient: pagerdutyClient,
-		commitHashSet:   map[string]bool{},
-		gitCache:        map[string]*time.Time{},
-		searchLabel:     searchLabel,
-		imageFilter:     imageFilters,
-		imageExcludes:   imageExcludes,
-	}, nil
+		commitLookupErrorsMetric: prometheus.NewDesc("dora:commit_lookup_errors_total",
+			"Counts the commits whose time could not be found on github",
+			[]string{"org", "repo"}, nil,
+		),
+		gitCacheHitsMetric: prometheus.NewDesc("dora:git_cache_hits_total",
+			"Counts the commit times served from the git cache",
+			nil, nil,
+		),
+		gitCacheMissesMetric: prometheus.NewDesc("dora:git_cache_misses_total",
+			"Counts the commit times not found in the git cache and requested to github",
+			nil, nil,
+		),
+		githubRateLimitMetric: prometheus.NewDesc("dora:github_rate_limit_remaining",
+			"Shows the remaining github api quota",
+			[]string{"resource"}, nil,
+		),
+		githubClient:            gh,
+		kubeClient:              kubeClient,
+		pagerdutyClient:         pagerdutyClient,
+		commitHashSet:           map[string]bool{},
+		gitCache:                map[string]*time.Time{},
+		commitLookupErrors:      map[commitLookupKey]float64{},
+		searchLabels:            opts.SearchLabels,
+		imageFilter:             opts.ImageFilters,
+		imageExcludes:           opts.ImageExcludes,
+		pagerdutyServiceIDs:     opts.PagerdutyServiceIDs,
+		scrapeTimeout:           opts.ScrapeTimeout,
+		failureLookback:         opts.FailureLookback,
+		githubMinRemainingQuota: opts.GithubMinRemainingQuota,
+		githubMaxRateLimitWait:  opts.GithubMaxRateLimitWait,
+	}
 }
 
 // Each and every collector must implement the Describe function. It essentially writes all descriptors to the prometheus desc channel.
 func (collector *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- collector.commitTimeMetric
 	ch <- collector.deployTimeMetric
+	ch <- collector.activeDeploymentMetric
+	ch <- collector.inactiveDeploymentMetric
+	ch <- collector.failure_creation_time
+	ch <- collector.failure_resolution_time
+	ch <- collector.commitLookupErrorsMetric
+	ch <- collector.gitCacheHitsMetric
+	ch <- collector.gitCacheMissesMetric
+	ch <- collector.githubRateLimitMetric
 }
 
 // Collect implements required collect function for all promehteus collectors
 func (collector *Collector) Collect(ch chan<- prometheus.Metric) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
 
 	// List all deployments having argocd label app.kubernetes.io/instance
 	// Use these deployments to get images and gather deploytime and commit time
@@ -123,35 +212,81 @@ func (collector *Collector) Collect(ch chan<- prometheus.Metric) {
 	// this map is used at each scraping to avoid parsing an image twice: duplicate metrics are not allowed by the collector and will throw an error
 	collector.commitHashSet = map[string]bool{}
 
-	deploymentList, err := collector.kubeClient.ListDeploymentsByLabels(collector.searchLabel)
+	// github and pagerduty calls share a per-scrape deadline, so a hung upstream can't stall the whole scrape:
+	// once it expires the remaining lookups fail fast and the metrics built from the cluster are still collected
+	ctx, cancel := context.WithTimeout(context.Background(), collector.scrapeTimeout)
+	defer cancel()
+
+	deployments, err := collector.listDeployments()
 	if err != nil {
 		klog.Error(err)
 		return
 	}
 
-	collector.CollectFailures(ch)
+	collector.CollectFailures(ctx, ch)
+	collector.CollectRateLimits(ctx, ch)
 	// loop through all deployments found
-	for _, depl := range deploymentList.Items {
+	for _, depl := range deployments {
 		// and get all container's images
 		for _, cont := range depl.Spec.Template.Spec.Containers {
 			// filter the images to only use the appstudio ones
 			isOk := filterImage(collector.imageFilter, cont.Image)
 			isExcluded := excludeImage(collector.imageExcludes, cont.Image)
+			// images without a commit hash can't be tied to a commit: skip all their series
+			if isOk && !isExcluded && reSubMatchMap(imageRegex, cont.Image)["hash"] == "" {
+				klog.V(3).Infof("no commit hash found in image %s", cont.Image)
+				continue
+			}
 			if isOk && !isExcluded {
-				collector.CollectCommitTime(ch, &depl, &cont)
+				collector.CollectCommitTime(ctx, ch, &depl, &cont)
 				collector.CollectDeployTime(ch, &depl, &cont)
 				collector.commitHashSet[cont.Image] = true
 			}
 		}
 	}
 
+	for key, count := range collector.commitLookupErrors {
+		ch <- prometheus.MustNewConstMetric(collector.commitLookupErrorsMetric, prometheus.CounterValue, count, key.org, key.repo)
+	}
+	ch <- prometheus.MustNewConstMetric(collector.gitCacheHitsMetric, prometheus.CounterValue, collector.gitCacheHits)
+	ch <- prometheus.MustNewConstMetric(collector.gitCacheMissesMetric, prometheus.CounterValue, collector.gitCacheMisses)
+}
+
+// listDeployments returns the deployments carrying any of the search labels, listing each deployment only once
+func (collector *Collector) listDeployments() ([]appsv1.Deployment, error) {
+	seen := map[string]bool{}
+	deployments := []appsv1.Deployment{}
+	for _, label := range collector.searchLabels {
+		deploymentList, err := collector.kubeClient.ListDeploymentsByLabels(label)
+		if err != nil {
+			return nil, err
+		}
+		for _, depl := range deploymentList.Items {
+			key := depl.Namespace + "/" + depl.Name
+			if !seen[key] {
+				seen[key] = true
+				deployments = append(deployments, depl)
+			}
+		}
+	}
+	return deployments, nil
 }
 
-func (collector *Collector) CollectCommitTime(ch chan<- prometheus.Metric, depl *appsv1.Deployment, cont *v1.Container) {
+// componentName returns the value of the first search label set on the deployment
+func (collector *Collector) componentName(depl *appsv1.Deployment) string {
+	for _, label := range collector.searchLabels {
+		if value, ok := depl.Labels[label]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func (collector *Collector) CollectCommitTime(ctx context.Context, ch chan<- prometheus.Metric, depl *appsv1.Deployment, cont *v1.Container) {
 	// check we have not parsed this image already
 	// get data needed for prometheus labels
 	namespace := depl.Namespace
-	component := depl.Labels[collector.searchLabel]
+	component := collector.componentName(depl)
 	// parse the image url to extract organization, repository and commit hash
 	fields := reSubMatchMap(imageRegex, cont.Image)
 
@@ -161,8 +296,10 @@ func (collector *Collector) CollectCommitTime(ch chan<- prometheus.Metric, depl
 		// if yes, use that value and return
 		commitTimeValue, commitCached := collector.gitCache[fields["hash"]]
 		if !commitCached {
+			collector.gitCacheMisses++
 			klog.V(3).Infof("Commit time is not cached yet: %s %s", fields["repo"], fields["hash"])
 		} else {
+			collector.gitCacheHits++
 			m1 := prometheus.MustNewConstMetric(collector.commitTimeMetric, prometheus.GaugeValue, float64(commitTimeValue.Unix()), component, fields["hash"], cont.Image, namespace)
 			// We let prometheus set the scraping timestamp; if we force-set it to the commit time we risk losing old out-of-bound data
 			ch <- m1
@@ -171,7 +308,7 @@ func (collector *Collector) CollectCommitTime(ch chan<- prometheus.Metric, depl
 		}
 
 		// if the data is not cached, look in github: first try is using org+repo+hash to directly get the data from the repo (we want to avoid searching for a generic hash)
-		commit, err := collector.githubClient.GetCommitFromOrgAndRepo(fields["org"], fields["repo"], fields["hash"])
+		commit, err := collector.githubClient.GetCommitFromOrgAndRepo(ctx, fields["org"], fields["repo"], fields["hash"])
 		if err != nil {
 			klog.V(3).Infof("Can't find commit time using %s, %s and %s: %s", fields["org"], fields["repo"], fields["hash"], err)
 		} else {
@@ -183,28 +320,79 @@ func (collector *Collector) CollectCommitTime(ch chan<- prometheus.Metric, depl
 			return
 		}
 
-		commit, err = collector.githubClient.SearchCommit(fields["hash"], fields["org"])
-		if err != nil {
-			// try again once
-			commit, err = collector.githubClient.SearchCommit(fields["hash"], fields["org"])
-			klog.V(3).Infof("Retrying search: %s - %s - %s: %s", fields["repo"], fields["hash"], fields["org"], err)
+		// searching is the non-essential fallback: when the search quota is running low, leave it for a later scrape
+		if collector.isSearchThrottled() {
+			klog.V(1).Infof("Deferring commit search for %s - %s: github search quota below %d until %s", fields["repo"], fields["hash"], collector.githubMinRemainingQuota, collector.githubRateLimits.Search.Reset)
+			return
 		}
 
+		commit, err = collector.searchCommitWithRetry(ctx, fields["hash"], fields["org"])
 		if err != nil {
-			// try again once
-			commit, err = collector.githubClient.SearchCommit(fields["hash"], fields["org"])
 			klog.V(1).Infof("Can't find commit either by get or search: %s - %s - %s: %s", fields["repo"], fields["hash"], fields["org"], err)
-		} else {
-			m1 := prometheus.MustNewConstMetric(collector.commitTimeMetric, prometheus.GaugeValue, float64(commit.Author.Date.Unix()), component, fields["hash"], cont.Image, namespace)
-			// We let prometheus set the scraping timestamp; if we force-set it to the commit time we risk losing old out-of-bound data
-			ch <- m1
-			klog.V(3).Infof("collected committime for %s", cont.Image, ": ", err)
-			collector.gitCache[fields["hash"]] = commit.Author.Date
+			// lookups cut short by the scrape deadline are retried at the next scrape, they are not missing commits
+			if ctx.Err() == nil {
+				collector.commitLookupErrors[commitLookupKey{org: fields["org"], repo: fields["repo"]}]++
+			}
 			return
 		}
 
+		m1 := prometheus.MustNewConstMetric(collector.commitTimeMetric, prometheus.GaugeValue, float64(commit.Author.Date.Unix()), component, fields["hash"], cont.Image, namespace)
+		// We let prometheus set the scraping timestamp; if we force-set it to the commit time we risk losing old out-of-bound data
+		ch <- m1
+		klog.V(3).Infof("collected committime for %s", cont.Image)
+		collector.gitCache[fields["hash"]] = commit.Author.Date
+	}
+
+}
+
+// searchCommitWithRetry searches the commit on github, retrying a bounded number of times with an increasing delay between attempts
+func (collector *Collector) searchCommitWithRetry(ctx context.Context, hash string, org string) (*github.Commit, error) {
+	var commit *github.Commit
+	var err error
+	for attempt := 1; attempt <= commitSearchAttempts; attempt++ {
+		commit, err = collector.githubClient.SearchCommit(ctx, hash, org)
+		// keep the known quota roughly up to date between two scrapes
+		if collector.githubRateLimits != nil && collector.githubRateLimits.Search != nil {
+			collector.githubRateLimits.Search.Remaining--
+		}
+		if err == nil {
+			return commit, nil
+		}
+		if attempt == commitSearchAttempts {
+			break
+		}
+
+		delay := time.Duration(attempt) * commitSearchBackoff
+		if wait, limited := rateLimitWait(err); limited {
+			if wait > collector.githubMaxRateLimitWait {
+				klog.Warningf("Github rate limit hit searching %s - %s: retry allowed in %s, more than the maximum wait of %s", hash, org, wait.Round(time.Second), collector.githubMaxRateLimitWait)
+				return nil, err
+			}
+			klog.Warningf("Github rate limit hit searching %s - %s: waiting %s before retrying", hash, org, wait.Round(time.Second))
+			delay = wait
+		} else if !isTransientError(err) {
+			// the commit is missing or ambiguous: retrying would only burn the scrape deadline
+			return nil, err
+		} else {
+			klog.V(3).Infof("Retrying search (attempt %d): %s - %s: %s", attempt, hash, org, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
 	}
+	return nil, err
+}
 
+// isSearchThrottled tells whether the github search quota dropped below the configured minimum and has not been reset yet
+func (collector *Collector) isSearchThrottled() bool {
+	if collector.githubMinRemainingQuota <= 0 || collector.githubRateLimits == nil || collector.githubRateLimits.Search == nil {
+		return false
+	}
+	search := collector.githubRateLimits.Search
+	return search.Remaining < collector.githubMinRemainingQuota && time.Now().Before(search.Reset.Time)
 }
 
 func (collector *Collector) CollectDeployTime(ch chan<- prometheus.Metric, depl *appsv1.Deployment, cont *v1.Container) {
@@ -213,7 +401,7 @@ func (collector *Collector) CollectDeployTime(ch chan<- prometheus.Metric, depl
 	if !ok {
 		// get data needed for prometheus labels
 		namespace := depl.Namespace
-		component := depl.Labels[collector.searchLabel]
+		component := collector.componentName(depl)
 		// parse the image url to extract organization, repository and commit hash
 		fields := reSubMatchMap(imageRegex, cont.Image)
 		// If the deployment is active we also collect the deploy time metric using the deployment creation timestamp
@@ -249,9 +437,13 @@ func (collector *Collector) CollectDeployTime(ch chan<- prometheus.Metric, depl
 	}
 }
 
-func (collector *Collector) CollectFailures(ch chan<- prometheus.Metric) {
+func (collector *Collector) CollectFailures(ctx context.Context, ch chan<- prometheus.Metric) {
+	// the pagerduty client is not set up when PAGERDUTY_API_KEY is missing
+	if collector.pagerdutyClient == nil {
+		return
+	}
 	klog.V(1).Info("Collecting failures...")
-	incidents, err := collector.pagerdutyClient.ListIncidentsWithContext(context.TODO(), pagerduty.ListIncidentsOptions{ServiceIDs: []string{"PL93A8P"}})
+	incidents, err := collector.pagerdutyClient.ListIncidentsWithContext(ctx, pagerduty.ListIncidentsOptions{ServiceIDs: collector.pagerdutyServiceIDs})
 
 	if err != nil {
 		klog.Error(err)
@@ -262,9 +454,10 @@ func (collector *Collector) CollectFailures(ch chan<- prometheus.Metric) {
 
 		creationTime, err := time.Parse(layout, inc.CreatedAt)
 		if err != nil {
-			klog.Error("error converting time for %s", inc.ID)
+			klog.Errorf("error converting time for %s: %s", inc.ID, err)
+			continue
 		}
-		isOkToIngest := creationTime.After(time.Now().Add(-5 * time.Minute))
+		isOkToIngest := creationTime.After(time.Now().Add(-collector.failureLookback))
 
 		if isOkToIngest {
 			m2 := prometheus.MustNewConstMetric(collector.failure_creation_time, prometheus.GaugeValue, float64(creationTime.Unix()), inc.ID, "global")
@@ -276,9 +469,10 @@ func (collector *Collector) CollectFailures(ch chan<- prometheus.Metric) {
 		if inc.Status == "resolved" {
 			resTime, err := time.Parse(layout, inc.ResolvedAt)
 			if err != nil {
-				klog.Error("error converting time for %s", inc.ID, err)
+				klog.Errorf("error converting time for %s: %s", inc.ID, err)
+				continue
 			}
-			isOkToIngest := resTime.After(time.Now().Add(-5 * time.Minute))
+			isOkToIngest := resTime.After(time.Now().Add(-collector.failureLookback))
 
 			if isOkToIngest {
 				m2 := prometheus.MustNewConstMetric(collector.failure_resolution_time, prometheus.GaugeValue, float64(resTime.Unix()), inc.ID, "global")
@@ -290,3 +484,20 @@ func (collector *Collector) CollectFailures(ch chan<- prometheus.Metric) {
 
 	}
 }
+
+func (collector *Collector) CollectRateLimits(ctx context.Context, ch chan<- prometheus.Metric) {
+	// checking the rate limits does not count against the github quota
+	limits, err := collector.githubClient.RateLimits(ctx)
+	if err != nil {
+		klog.Errorf("can't get github rate limits: %s", err)
+		return
+	}
+	collector.githubRateLimits = limits
+
+	if limits.Core != nil {
+		ch <- prometheus.MustNewConstMetric(collector.githubRateLimitMetric, prometheus.GaugeValue, float64(limits.Core.Remaining), "core")
+	}
+	if limits.Search != nil {
+		ch <- prometheus.MustNewConstMetric(collector.githubRateLimitMetric, prometheus.GaugeValue, float64(limits.Search.Remaining), "search")
+	}
+}
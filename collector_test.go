@@ -0,0 +1,457 @@
+//
+// Copyright (c) 2023 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/albarbaro/go-pagerduty"
+	"github.com/google/go-github/v48/github"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testImage = "quay.io/redhat-appstudio/build-service:0123456789abcdef"
+
+// fakeGithub answers commit lookups from canned values and counts the calls it receives
+type fakeGithub struct {
+	commit       *github.Commit
+	getErr       error
+	searchErr    error
+	searchFails  int // number of SearchCommit calls failing with searchErr before succeeding, -1 always fails
+	getCalls     int
+	searchCalls  int
+	limits       *github.RateLimits
+	blockOnCalls bool // block every commit lookup until the context is done
+}
+
+func (f *fakeGithub) SearchCommit(ctx context.Context, hash string, org string) (*github.Commit, error) {
+	f.searchCalls++
+	if f.blockOnCalls {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if f.searchFails < 0 || f.searchCalls <= f.searchFails {
+		return nil, f.searchErr
+	}
+	return f.commit, nil
+}
+
+func (f *fakeGithub) GetCommitFromOrgAndRepo(ctx context.Context, org string, repo string, hash string) (*github.Commit, error) {
+	f.getCalls++
+	if f.blockOnCalls {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	return f.commit, nil
+}
+
+func (f *fakeGithub) RateLimits(ctx context.Context) (*github.RateLimits, error) {
+	if f.limits == nil {
+		return nil, fmt.Errorf("no rate limits")
+	}
+	return f.limits, nil
+}
+
+func newTestCommit(date time.Time) *github.Commit {
+	return &github.Commit{Author: &github.CommitAuthor{Date: &date}}
+}
+
+func newTestCollector(gh githubAPI) *Collector {
+	return newCollector(CollectorOptions{
+		SearchLabels:           []string{APP_LABEL},
+		ImageFilters:           []string{"quay.io/redhat-appstudio/"},
+		ScrapeTimeout:          time.Second,
+		FailureLookback:        15 * time.Minute,
+		GithubMaxRateLimitWait: time.Second,
+	}, gh, nil, nil)
+}
+
+func newTestDeployment(name string, labels map[string]string, image string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test", Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{Containers: []v1.Container{{Name: "container", Image: image}}},
+			},
+		},
+	}
+}
+
+// shortenBackoff keeps the retry tests fast
+func shortenBackoff(t *testing.T) {
+	backoff := commitSearchBackoff
+	commitSearchBackoff = time.Millisecond
+	t.Cleanup(func() { commitSearchBackoff = backoff })
+}
+
+// drain collects the metrics sent by fn
+func drain(fn func(ch chan<- prometheus.Metric)) []prometheus.Metric {
+	ch := make(chan prometheus.Metric, 100)
+	fn(ch)
+	close(ch)
+	metrics := []prometheus.Metric{}
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func countMetrics(metrics []prometheus.Metric, desc *prometheus.Desc) int {
+	count := 0
+	for _, m := range metrics {
+		if m.Desc() == desc {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSearchCommitRetriesTransientErrors(t *testing.T) {
+	shortenBackoff(t)
+	gh := &fakeGithub{
+		commit:      newTestCommit(time.Now()),
+		searchErr:   &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusBadGateway}},
+		searchFails: 2,
+	}
+	collector := newTestCollector(gh)
+
+	commit, err := collector.searchCommitWithRetry(context.Background(), "0123456789abcdef", "redhat-appstudio")
+	if err != nil {
+		t.Fatalf("expected the search to succeed after retrying, got %s", err)
+	}
+	if commit != gh.commit {
+		t.Errorf("expected the commit returned by the last search")
+	}
+	if gh.searchCalls != 3 {
+		t.Errorf("expected 3 search attempts, got %d", gh.searchCalls)
+	}
+}
+
+func TestSearchCommitDoesNotRetryPermanentErrors(t *testing.T) {
+	shortenBackoff(t)
+	gh := &fakeGithub{
+		searchErr:   fmt.Errorf("error getting commit: no data found for 0123456789abcdef"),
+		searchFails: -1,
+	}
+	collector := newTestCollector(gh)
+
+	if _, err := collector.searchCommitWithRetry(context.Background(), "0123456789abcdef", "redhat-appstudio"); err == nil {
+		t.Fatal("expected the search to fail")
+	}
+	if gh.searchCalls != 1 {
+		t.Errorf("expected a single search attempt, got %d", gh.searchCalls)
+	}
+}
+
+func TestCollectCommitTimeCountsLookupErrors(t *testing.T) {
+	shortenBackoff(t)
+	gh := &fakeGithub{
+		getErr:      fmt.Errorf("not found"),
+		searchErr:   &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+		searchFails: -1,
+	}
+	collector := newTestCollector(gh)
+	depl := newTestDeployment("build-service", map[string]string{APP_LABEL: "build-service"}, testImage)
+
+	metrics := drain(func(ch chan<- prometheus.Metric) {
+		collector.CollectCommitTime(context.Background(), ch, depl, &depl.Spec.Template.Spec.Containers[0])
+	})
+
+	if len(metrics) != 0 {
+		t.Errorf("expected no commit time metric, got %d metrics", len(metrics))
+	}
+	if gh.searchCalls != commitSearchAttempts {
+		t.Errorf("expected %d search attempts, got %d", commitSearchAttempts, gh.searchCalls)
+	}
+	key := commitLookupKey{org: "redhat-appstudio", repo: "build-service"}
+	if collector.commitLookupErrors[key] != 1 {
+		t.Errorf("expected one lookup error for %v, got %v", key, collector.commitLookupErrors[key])
+	}
+}
+
+func TestCollectorMetricsAreDescribed(t *testing.T) {
+	gh := &fakeGithub{
+		commit: newTestCommit(time.Now()),
+		limits: &github.RateLimits{
+			Core:   &github.Rate{Limit: 5000, Remaining: 4000},
+			Search: &github.Rate{Limit: 30, Remaining: 20},
+		},
+	}
+	collector := newTestCollector(gh)
+	depl := newTestDeployment("build-service", map[string]string{APP_LABEL: "build-service"}, testImage)
+	collector.kubeClient = &KubeClients{kubeClient: fake.NewSimpleClientset(depl)}
+	collector.commitLookupErrors[commitLookupKey{org: "redhat-appstudio", repo: "other"}] = 1
+
+	// only the pedantic registry checks the collected metrics against the described ones
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering the collector metrics failed: %s", err)
+	}
+
+	gathered := map[string]bool{}
+	for _, family := range families {
+		gathered[family.GetName()] = true
+	}
+	for _, name := range []string{"dora:committime", "dora:deployinactive", "dora:commit_lookup_errors_total", "dora:git_cache_misses_total", "dora:github_rate_limit_remaining"} {
+		if !gathered[name] {
+			t.Errorf("expected %s to be gathered", name)
+		}
+	}
+}
+
+func TestCollectWithCustomImageFilters(t *testing.T) {
+	gh := &fakeGithub{commit: newTestCommit(time.Now())}
+	collector := newCollector(CollectorOptions{
+		SearchLabels:  []string{APP_LABEL},
+		ImageFilters:  []string{"ghcr.io/acme/"},
+		ImageExcludes: []string{"ghcr.io/acme/skipped"},
+		ScrapeTimeout: time.Second,
+	}, gh, nil, nil)
+	if len(collector.imageFilter) != 1 || collector.imageFilter[0] != "ghcr.io/acme/" {
+		t.Fatalf("expected the custom image filters, got %v", collector.imageFilter)
+	}
+
+	collector.kubeClient = &KubeClients{kubeClient: fake.NewSimpleClientset(
+		newTestDeployment("api", map[string]string{APP_LABEL: "api"}, "ghcr.io/acme/api:0123456789abcdef"),
+		newTestDeployment("skipped", map[string]string{APP_LABEL: "skipped"}, "ghcr.io/acme/skipped:0123456789abcdef"),
+		newTestDeployment("build-service", map[string]string{APP_LABEL: "build-service"}, testImage),
+	)}
+
+	metrics := drain(collector.Collect)
+
+	if count := countMetrics(metrics, collector.commitTimeMetric); count != 1 {
+		t.Errorf("expected a commit time for the ghcr.io/acme/api image only, got %d", count)
+	}
+	if count := countMetrics(metrics, collector.inactiveDeploymentMetric); count != 1 {
+		t.Errorf("expected an inactive deployment for the ghcr.io/acme/api image only, got %d", count)
+	}
+}
+
+func TestCollectRespectsScrapeTimeout(t *testing.T) {
+	gh := &fakeGithub{blockOnCalls: true}
+	collector := newTestCollector(gh)
+	collector.scrapeTimeout = 50 * time.Millisecond
+	collector.kubeClient = &KubeClients{kubeClient: fake.NewSimpleClientset(
+		newTestDeployment("build-service", map[string]string{APP_LABEL: "build-service"}, testImage),
+		newTestDeployment("integration-service", map[string]string{APP_LABEL: "integration-service"}, "quay.io/redhat-appstudio/integration-service:fedcba9876543210"),
+	)}
+
+	done := make(chan []prometheus.Metric)
+	go func() {
+		done <- drain(collector.Collect)
+	}()
+
+	select {
+	case metrics := <-done:
+		if count := countMetrics(metrics, collector.commitTimeMetric); count != 0 {
+			t.Errorf("expected no commit time once github timed out, got %d", count)
+		}
+		if count := countMetrics(metrics, collector.inactiveDeploymentMetric); count != 2 {
+			t.Errorf("expected the deployment metrics to be collected despite the timeout, got %d", count)
+		}
+		if len(collector.commitLookupErrors) != 0 {
+			t.Errorf("expected timed out lookups not to be counted as errors, got %v", collector.commitLookupErrors)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scrape did not honor the scrape timeout")
+	}
+}
+
+func TestCollectCommitTimeCachesCommits(t *testing.T) {
+	gh := &fakeGithub{commit: newTestCommit(time.Now())}
+	collector := newTestCollector(gh)
+	depl := newTestDeployment("build-service", map[string]string{APP_LABEL: "build-service"}, testImage)
+
+	for scrape := 1; scrape <= 2; scrape++ {
+		// each scrape starts with an empty set of parsed images
+		collector.commitHashSet = map[string]bool{}
+		metrics := drain(func(ch chan<- prometheus.Metric) {
+			collector.CollectCommitTime(context.Background(), ch, depl, &depl.Spec.Template.Spec.Containers[0])
+		})
+		if count := countMetrics(metrics, collector.commitTimeMetric); count != 1 {
+			t.Errorf("scrape %d: expected one commit time, got %d", scrape, count)
+		}
+	}
+
+	if collector.gitCacheMisses != 1 || collector.gitCacheHits != 1 {
+		t.Errorf("expected one miss then one hit, got %v misses and %v hits", collector.gitCacheMisses, collector.gitCacheHits)
+	}
+	if gh.getCalls != 1 {
+		t.Errorf("expected github to be called once, got %d calls", gh.getCalls)
+	}
+}
+
+// fakePagerduty returns a fixed list of incidents
+type fakePagerduty struct {
+	incidents []pagerduty.Incident
+}
+
+func (f *fakePagerduty) ListIncidentsWithContext(ctx context.Context, o pagerduty.ListIncidentsOptions) (*pagerduty.ListIncidentsResponse, error) {
+	return &pagerduty.ListIncidentsResponse{Incidents: f.incidents}, nil
+}
+
+func TestCollectFailuresHonorsLookback(t *testing.T) {
+	ago := func(d time.Duration) string {
+		return time.Now().Add(-d).UTC().Format("2006-01-02T15:04:05Z")
+	}
+	pd := &fakePagerduty{incidents: []pagerduty.Incident{
+		{APIObject: pagerduty.APIObject{ID: "recent"}, CreatedAt: ago(10 * time.Minute), Status: "triggered"},
+		{APIObject: pagerduty.APIObject{ID: "recently-resolved"}, CreatedAt: ago(time.Hour), Status: "resolved", ResolvedAt: ago(5 * time.Minute)},
+		{APIObject: pagerduty.APIObject{ID: "old"}, CreatedAt: ago(2 * time.Hour), Status: "resolved", ResolvedAt: ago(time.Hour)},
+		{APIObject: pagerduty.APIObject{ID: "invalid"}, CreatedAt: "not a time", Status: "triggered"},
+	}}
+	collector := newCollector(CollectorOptions{FailureLookback: 15 * time.Minute}, &fakeGithub{}, nil, pd)
+
+	metrics := drain(func(ch chan<- prometheus.Metric) {
+		collector.CollectFailures(context.Background(), ch)
+	})
+
+	if count := countMetrics(metrics, collector.failure_creation_time); count != 1 {
+		t.Errorf("expected one incident created within the lookback, got %d", count)
+	}
+	if count := countMetrics(metrics, collector.failure_resolution_time); count != 1 {
+		t.Errorf("expected one incident resolved within the lookback, got %d", count)
+	}
+}
+
+func TestCollectWithAlternateSearchLabel(t *testing.T) {
+	collector := newTestCollector(&fakeGithub{})
+	collector.searchLabels = []string{APP_LABEL, "argocd.argoproj.io/instance"}
+	collector.kubeClient = &KubeClients{kubeClient: fake.NewSimpleClientset(
+		newTestDeployment("build-service", map[string]string{APP_LABEL: "build-service"}, testImage),
+		newTestDeployment("release-service", map[string]string{"argocd.argoproj.io/instance": "release-service"}, testImage),
+		newTestDeployment("both", map[string]string{APP_LABEL: "first", "argocd.argoproj.io/instance": "second"}, testImage),
+	)}
+
+	deployments, err := collector.listDeployments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	components := map[string]string{}
+	for i := range deployments {
+		components[deployments[i].Name] = collector.componentName(&deployments[i])
+	}
+
+	expected := map[string]string{"build-service": "build-service", "release-service": "release-service", "both": "first"}
+	if len(deployments) != len(expected) {
+		t.Errorf("expected each deployment to be listed once, got %d deployments", len(deployments))
+	}
+	for name, component := range expected {
+		if components[name] != component {
+			t.Errorf("expected component %q for %s, got %q", component, name, components[name])
+		}
+	}
+}
+
+func TestIsSearchThrottled(t *testing.T) {
+	future := github.Timestamp{Time: time.Now().Add(time.Minute)}
+	past := github.Timestamp{Time: time.Now().Add(-time.Minute)}
+	tests := []struct {
+		name      string
+		minQuota  int
+		search    *github.Rate
+		throttled bool
+	}{
+		{"disabled", 0, &github.Rate{Remaining: 0, Reset: future}, false},
+		{"unknown limits", 10, nil, false},
+		{"enough quota", 10, &github.Rate{Remaining: 20, Reset: future}, false},
+		{"low quota", 10, &github.Rate{Remaining: 5, Reset: future}, true},
+		{"low quota already reset", 10, &github.Rate{Remaining: 5, Reset: past}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := newTestCollector(&fakeGithub{})
+			collector.githubMinRemainingQuota = tt.minQuota
+			if tt.search != nil {
+				collector.githubRateLimits = &github.RateLimits{Search: tt.search}
+			}
+			if got := collector.isSearchThrottled(); got != tt.throttled {
+				t.Errorf("expected throttled to be %v, got %v", tt.throttled, got)
+			}
+		})
+	}
+}
+
+func TestCollectCommitTimeDefersSearchWhenThrottled(t *testing.T) {
+	gh := &fakeGithub{getErr: fmt.Errorf("not found"), commit: newTestCommit(time.Now())}
+	collector := newTestCollector(gh)
+	collector.githubMinRemainingQuota = 10
+	collector.githubRateLimits = &github.RateLimits{
+		Search: &github.Rate{Remaining: 5, Reset: github.Timestamp{Time: time.Now().Add(time.Minute)}},
+	}
+	depl := newTestDeployment("build-service", map[string]string{APP_LABEL: "build-service"}, testImage)
+
+	drain(func(ch chan<- prometheus.Metric) {
+		collector.CollectCommitTime(context.Background(), ch, depl, &depl.Spec.Template.Spec.Containers[0])
+	})
+
+	if gh.getCalls != 1 {
+		t.Errorf("expected the direct commit lookup to proceed, got %d calls", gh.getCalls)
+	}
+	if gh.searchCalls != 0 {
+		t.Errorf("expected the search to be deferred, got %d calls", gh.searchCalls)
+	}
+	if len(collector.commitLookupErrors) != 0 {
+		t.Errorf("expected a deferred search not to count as a lookup error, got %v", collector.commitLookupErrors)
+	}
+}
+
+func TestSearchCommitGivesUpOnLongSecondaryRateLimit(t *testing.T) {
+	shortenBackoff(t)
+	gh := &fakeGithub{searchErr: &github.AbuseRateLimitError{}, searchFails: -1}
+	collector := newTestCollector(gh)
+
+	if _, err := collector.searchCommitWithRetry(context.Background(), "0123456789abcdef", "redhat-appstudio"); err == nil {
+		t.Fatal("expected the search to fail")
+	}
+	if gh.searchCalls != 1 {
+		t.Errorf("expected no retry while the secondary rate limit lasts longer than the maximum wait, got %d calls", gh.searchCalls)
+	}
+}
+
+func TestCollectSkipsImagesWithoutCommitHash(t *testing.T) {
+	gh := &fakeGithub{commit: newTestCommit(time.Now())}
+	collector := newTestCollector(gh)
+	collector.kubeClient = &KubeClients{kubeClient: fake.NewSimpleClientset(
+		newTestDeployment("untagged", map[string]string{APP_LABEL: "untagged"}, "quay.io/redhat-appstudio/untagged"),
+		newTestDeployment("empty-tag", map[string]string{APP_LABEL: "empty-tag"}, "quay.io/redhat-appstudio/empty-tag:"),
+		newTestDeployment("short-tag", map[string]string{APP_LABEL: "short-tag"}, "quay.io/redhat-appstudio/short-tag:abc12"),
+	)}
+
+	metrics := drain(collector.Collect)
+
+	if count := countMetrics(metrics, collector.commitTimeMetric); count != 1 {
+		t.Errorf("expected a commit time for the short tag image only, got %d", count)
+	}
+	if count := countMetrics(metrics, collector.inactiveDeploymentMetric); count != 1 {
+		t.Errorf("expected a deployment series for the short tag image only, got %d", count)
+	}
+	if gh.getCalls != 1 {
+		t.Errorf("expected github to be called for the short tag image only, got %d calls", gh.getCalls)
+	}
+}
@@ -16,60 +16,153 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v48/github"
 	"golang.org/x/oauth2"
 	"k8s.io/klog/v2"
 )
 
+// githubAPI is the part of the github client used by the collector
+type githubAPI interface {
+	SearchCommit(ctx context.Context, hash string, org string) (*github.Commit, error)
+	GetCommitFromOrgAndRepo(ctx context.Context, org string, repo string, hash string) (*github.Commit, error)
+	RateLimits(ctx context.Context) (*github.RateLimits, error)
+}
+
 type GithubClient struct {
-	gh    *github.Client
-	token string
+	gh         *github.Client
+	token      string
+	enterprise bool
 }
 
 func NewGithubClient() (*GithubClient, error) {
-	key := "GITHUB_TOKEN"
-	val, ok := os.LookupEnv(key)
-	if !ok {
-		klog.Errorf("%s not set\n", key)
-		return nil, fmt.Errorf("%s not set", key)
+	gh_client := &GithubClient{}
+
+	// a github app installation gets a higher rate limit than a personal access token: use it when configured
+	appTransport, err := newGithubAppTransport()
+	if err != nil {
+		klog.Errorf("can't set up the github app authentication: %s", err)
+		return nil, err
 	}
-	if val == "" {
-		klog.Errorf("%s is empty\n", key)
+
+	var httpClient *http.Client
+	if appTransport != nil {
+		klog.V(1).Info("Using github app installation authentication")
+		httpClient = &http.Client{Transport: appTransport}
+	} else {
+		key := "GITHUB_TOKEN"
+		val, ok := os.LookupEnv(key)
+		if !ok {
+			klog.Errorf("%s not set\n", key)
+			return nil, fmt.Errorf("%s not set", key)
+		}
+		if val == "" {
+			klog.Errorf("%s is empty\n", key)
+		}
+		ts := oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: val},
+		)
+		httpClient = oauth2.NewClient(context.Background(), ts)
+		gh_client.token = val
 	}
 
-	gh_client := &GithubClient{}
+	// GITHUB_BASE_URL points the client to a github enterprise server, the upload url defaults to the same host
+	baseURL := os.Getenv("GITHUB_BASE_URL")
+	uploadURL := os.Getenv("GITHUB_UPLOAD_URL")
+	if baseURL == "" && uploadURL != "" {
+		klog.Warningf("GITHUB_UPLOAD_URL is ignored: GITHUB_BASE_URL is not set")
+	}
+	if uploadURL == "" {
+		uploadURL = baseURL
+	}
 
-	gh := gh_client.InitClient(val)
+	gh, err := gh_client.InitClient(httpClient, baseURL, uploadURL)
+	if err != nil {
+		klog.Errorf("can't create the github client: %s", err)
+		return nil, err
+	}
+	if appTransport != nil {
+		// installation tokens are requested to the same api server the client talks to
+		appTransport.BaseURL = strings.TrimSuffix(gh.BaseURL.String(), "/")
+	}
 	gh_client.gh = gh
-	gh_client.token = val
 
 	return gh_client, nil
 }
 
-func (gc *GithubClient) InitClient(val string) *github.Client {
-	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: val},
-	)
-	tc := oauth2.NewClient(ctx, ts)
+// newGithubAppTransport builds an auto-refreshing github app installation transport from
+// GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID and GITHUB_APP_PRIVATE_KEY_PATH. It returns nil when no app is configured
+func newGithubAppTransport() (*ghinstallation.Transport, error) {
+	appIDValue, ok := os.LookupEnv("GITHUB_APP_ID")
+	if !ok || appIDValue == "" {
+		return nil, nil
+	}
+	appID, err := strconv.ParseInt(appIDValue, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GITHUB_APP_ID %s: %w", appIDValue, err)
+	}
+	installationIDValue := os.Getenv("GITHUB_APP_INSTALLATION_ID")
+	installationID, err := strconv.ParseInt(installationIDValue, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GITHUB_APP_INSTALLATION_ID %s: %w", installationIDValue, err)
+	}
+	keyPath := os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH")
+	if keyPath == "" {
+		return nil, fmt.Errorf("GITHUB_APP_PRIVATE_KEY_PATH not set")
+	}
+
+	return ghinstallation.NewKeyFromFile(http.DefaultTransport, appID, installationID, keyPath)
+}
+
+func (gc *GithubClient) InitClient(httpClient *http.Client, baseURL string, uploadURL string) (*github.Client, error) {
+	if baseURL == "" {
+		return github.NewClient(httpClient), nil
+	}
+
+	for _, u := range []string{baseURL, uploadURL} {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("invalid github url %s: %w", u, err)
+		}
+		if (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid github url %s: an absolute http(s) url is expected", u)
+		}
+	}
 
-	gh := github.NewClient(tc)
-	return gh
+	// the enterprise client adds the /api/v3/ and /api/uploads/ paths the github enterprise apis are served from
+	gh, err := github.NewEnterpriseClient(baseURL, uploadURL, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	klog.V(1).Infof("Using github enterprise at %s", gh.BaseURL)
+	gc.enterprise = true
+	return gh, nil
 }
 
 func (gc *GithubClient) Client() *github.Client {
 	return gc.gh
 }
 
-func (gc *GithubClient) SearchCommit(hash string, org string) (*github.Commit, error) {
-	query := "hash:" + hash + " is:public"
+func (gc *GithubClient) SearchCommit(ctx context.Context, hash string, org string) (*github.Commit, error) {
+	query := "hash:" + hash
+	// on github.com only public repositories are searched, an enterprise server also holds the private and internal ones
+	if !gc.enterprise {
+		query = query + " is:public"
+	}
 	if len(org) > 0 {
 		query = query + " org:" + org
 	}
-	commits, _, err := gc.Client().Search.Commits(context.Background(), query, &github.SearchOptions{})
+	commits, _, err := gc.Client().Search.Commits(ctx, query, &github.SearchOptions{})
 	if err != nil {
 		//fmt.Println("Search error: ", err)
 		return nil, err
@@ -85,13 +178,13 @@ func (gc *GithubClient) SearchCommit(hash string, org string) (*github.Commit, e
 	return commit, nil
 }
 
-func (gc *GithubClient) GetCommitFromOrgAndRepo(org string, repo string, hash string) (*github.Commit, error) {
+func (gc *GithubClient) GetCommitFromOrgAndRepo(ctx context.Context, org string, repo string, hash string) (*github.Commit, error) {
 	searchOrg := org
 	new_org := gc.LookupOrg(repo)
 	if new_org != "" {
 		searchOrg = new_org
 	}
-	commits, _, err := gc.Client().Repositories.GetCommit(context.Background(), searchOrg, repo, hash, &github.ListOptions{})
+	commits, _, err := gc.Client().Repositories.GetCommit(ctx, searchOrg, repo, hash, &github.ListOptions{})
 
 	if err != nil {
 		//fmt.Println("Can't get ", hash, " use search instead")
@@ -102,6 +195,43 @@ func (gc *GithubClient) GetCommitFromOrgAndRepo(org string, repo string, hash st
 	return commit, nil
 }
 
+func (gc *GithubClient) RateLimits(ctx context.Context) (*github.RateLimits, error) {
+	limits, _, err := gc.Client().RateLimits(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+const secondaryRateLimitWait time.Duration = time.Minute
+
+// rateLimitWait tells whether err is a github rate limit error and, if so, how long github asks to wait before retrying
+func rateLimitWait(err error) (time.Duration, bool) {
+	var rateLimitErr *github.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return time.Until(rateLimitErr.Rate.Reset.Time), true
+	}
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		if abuseErr.RetryAfter != nil {
+			return *abuseErr.RetryAfter, true
+		}
+		// without Retry-After github asks to wait at least a minute before retrying a secondary rate limit
+		return secondaryRateLimitWait, true
+	}
+	return 0, false
+}
+
+// isTransientError tells whether a github call failed for a reason that may go away on retry: network errors and server side errors
+func isTransientError(err error) bool {
+	var respErr *github.ErrorResponse
+	if errors.As(err, &respErr) {
+		return respErr.Response != nil && respErr.Response.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
 func (gc *GithubClient) LookupOrg(repo string) string {
 
 	repos := map[string]string{
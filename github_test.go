@@ -0,0 +1,157 @@
+//
+// Copyright (c) 2023 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v48/github"
+)
+
+func writeTestPrivateKey(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewGithubAppTransport(t *testing.T) {
+	keyPath := writeTestPrivateKey(t)
+	tests := []struct {
+		name           string
+		appID          string
+		installationID string
+		keyPath        string
+		configured     bool
+		wantErr        bool
+	}{
+		{name: "no app configured"},
+		{name: "app configured", appID: "1234", installationID: "5678", keyPath: keyPath, configured: true},
+		{name: "invalid app id", appID: "app", installationID: "5678", keyPath: keyPath, wantErr: true},
+		{name: "missing installation id", appID: "1234", keyPath: keyPath, wantErr: true},
+		{name: "missing private key", appID: "1234", installationID: "5678", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GITHUB_APP_ID", tt.appID)
+			t.Setenv("GITHUB_APP_INSTALLATION_ID", tt.installationID)
+			t.Setenv("GITHUB_APP_PRIVATE_KEY_PATH", tt.keyPath)
+
+			transport, err := newGithubAppTransport()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if (transport != nil) != tt.configured {
+				t.Errorf("expected a transport %v, got %v", tt.configured, transport)
+			}
+		})
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	retryAfter := 3 * time.Second
+	reset := github.Timestamp{Time: time.Now().Add(time.Hour)}
+	tests := []struct {
+		name    string
+		err     error
+		limited bool
+		minWait time.Duration
+		maxWait time.Duration
+	}{
+		{"not a rate limit", fmt.Errorf("not found"), false, 0, 0},
+		{"primary rate limit", &github.RateLimitError{Rate: github.Rate{Reset: reset}}, true, 59 * time.Minute, time.Hour},
+		{"secondary rate limit with retry after", &github.AbuseRateLimitError{RetryAfter: &retryAfter}, true, retryAfter, retryAfter},
+		{"secondary rate limit without retry after", &github.AbuseRateLimitError{}, true, secondaryRateLimitWait, secondaryRateLimitWait},
+		{"wrapped secondary rate limit", fmt.Errorf("search: %w", &github.AbuseRateLimitError{RetryAfter: &retryAfter}), true, retryAfter, retryAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, limited := rateLimitWait(tt.err)
+			if limited != tt.limited {
+				t.Fatalf("expected limited to be %v, got %v", tt.limited, limited)
+			}
+			if wait < tt.minWait || wait > tt.maxWait {
+				t.Errorf("expected a wait between %s and %s, got %s", tt.minWait, tt.maxWait, wait)
+			}
+		})
+	}
+}
+
+func TestEnterpriseClientUsesAPIv3Path(t *testing.T) {
+	paths := []string{}
+	queries := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v3/repos/acme/api/commits/0123456789abcdef":
+			fmt.Fprint(w, `{"sha":"0123456789abcdef","commit":{"author":{"date":"2023-06-01T10:00:00Z"}}}`)
+		case "/api/v3/search/commits":
+			queries = append(queries, r.URL.Query().Get("q"))
+			fmt.Fprint(w, `{"total_count":1,"items":[{"sha":"0123456789abcdef","commit":{"author":{"date":"2023-06-01T10:00:00Z"}}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	gc := &GithubClient{}
+	gh, err := gc.InitClient(srv.Client(), srv.URL, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc.gh = gh
+
+	if _, err := gc.GetCommitFromOrgAndRepo(context.Background(), "acme", "api", "0123456789abcdef"); err != nil {
+		t.Errorf("getting the commit failed: %s", err)
+	}
+	if _, err := gc.SearchCommit(context.Background(), "0123456789abcdef", "acme"); err != nil {
+		t.Errorf("searching the commit failed: %s", err)
+	}
+
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/api/v3/") {
+			t.Errorf("expected requests under /api/v3/, got %s", path)
+		}
+	}
+	if len(queries) != 1 || strings.Contains(queries[0], "is:public") {
+		t.Errorf("expected a search query without is:public on enterprise, got %v", queries)
+	}
+}
+
+func TestInitClientRejectsInvalidEnterpriseURL(t *testing.T) {
+	gc := &GithubClient{}
+	if _, err := gc.InitClient(http.DefaultClient, "github.example.com", ""); err == nil {
+		t.Error("expected a relative base url to be rejected")
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/albarbaro/go-pagerduty v0.0.0-20230622090717-608750699b58
 	github.com/andygrunwald/go-jira v1.16.0
 	github.com/argoproj/argo-cd/v2 v2.4.15
+	github.com/bradleyfalzon/ghinstallation/v2 v2.0.4
 	github.com/google/go-github/v48 v48.1.0
 	github.com/prometheus/client_golang v1.11.0
 	golang.org/x/oauth2 v0.0.0-20220608161450-d0670ef3b1eb
@@ -29,7 +30,6 @@ require (
 	github.com/argoproj/pkg v0.11.1-0.20211203175135-36c59d8fafe0 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/bombsimon/logrusr/v2 v2.0.1 // indirect
-	github.com/bradleyfalzon/ghinstallation/v2 v2.0.4 // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/chai2010/gettext-go v0.0.0-20170215093142-bf70f2a70fb1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -0,0 +1,46 @@
+//
+// Copyright (c) 2023 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/klog/v2"
+)
+
+// healthzHandler only tells the exporter is alive: it checks no dependency, so a slow upstream can't get the pod restarted
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// readyzHandler reports the status of each dependency needed to collect metrics, answering 503 when one is down.
+// Github and pagerduty are not checked: without them the deployment metrics are still collected
+func readyzHandler(kubeClient *KubeClients) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := http.StatusOK
+		status := map[string]string{"kubernetes": "ok"}
+		if err := kubeClient.Ping(r.Context()); err != nil {
+			klog.Errorf("kubernetes api is not reachable: %s", err)
+			status["kubernetes"] = err.Error()
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	}
+}
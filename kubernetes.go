@@ -23,12 +23,15 @@ var (
 	scheme = runtime.NewScheme()
 )
 
+// pingTimeout stays below the readiness probe timeout
+const pingTimeout time.Duration = 3 * time.Second
+
 func init() {
 	utilruntime.Must(argocd.AddToScheme(scheme))
 }
 
 type KubeClients struct {
-	kubeClient *kubernetes.Clientset
+	kubeClient kubernetes.Interface
 	crClient   crclient.Client
 }
 
@@ -56,7 +59,7 @@ func NewKubeClient() (*KubeClients, error) {
 	}, nil
 }
 
-func (k *KubeClients) Clientset() *kubernetes.Clientset {
+func (k *KubeClients) Clientset() kubernetes.Interface {
 	return k.kubeClient
 }
 
@@ -64,6 +67,11 @@ func (k *KubeClients) REST() crclient.Client {
 	return k.crClient
 }
 
+// Ping checks the kubernetes api server can be reached, giving up after the ping timeout so a stuck api server can't pile up callers
+func (k *KubeClients) Ping(ctx context.Context) error {
+	return k.kubeClient.Discovery().RESTClient().Get().AbsPath("/version").Timeout(pingTimeout).Do(ctx).Error()
+}
+
 func (k *KubeClients) ListArgoCDApps() (*argocd.ApplicationList, error) {
 	//labels := map[string]string{"app.kubernetes.io/instance": "all-components-staging"}
 
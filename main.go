@@ -18,6 +18,7 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"time"
 
 	"k8s.io/klog/v2"
 
@@ -29,10 +30,32 @@ func main() {
 	klog.InitFlags(nil)
 	defer klog.Flush()
 	flag.Set("v", "1")
+	searchLabels := flag.String("search-label", APP_LABEL, "comma separated list of labels used to find the deployments to collect metrics for, the first one set on a deployment names the component")
+	imageFilters := flag.String("image-filters", "quay.io/redhat-appstudio/,quay.io/redhat-appstudio-qe/,quay.io/stolostrn/,quay.io/abarbaro/", "comma separated list of image prefixes to collect metrics for")
+	imageExcludes := flag.String("image-excludes", "quay.io/redhat-appstudio/gitopsdepl,quay.io/redhat-appstudio/user-workload", "comma separated list of image prefixes to exclude from the collection")
+	pagerdutyServiceIDs := flag.String("pagerduty-service-ids", "PL93A8P", "comma separated list of pagerduty services to collect failures from")
+	scrapeTimeout := flag.Duration("scrape-timeout", 25*time.Second, "maximum time spent calling github and pagerduty during a scrape, keep it below the prometheus scrape timeout (30s in the ServiceMonitor)")
+	failureLookback := flag.Duration("failure-lookback", 15*time.Minute, "how far back incidents are ingested at each scrape, keep it larger than the prometheus scrape interval")
+	githubMinRemainingQuota := flag.Int("github-min-remaining-quota", 0, "defer commit searches while the remaining github search quota is below this value, 0 disables the check")
+	githubMaxRateLimitWait := flag.Duration("github-max-rate-limit-wait", 5*time.Second, "longest time a commit search waits for a github rate limit to reset before retrying")
 	flag.Parse()
 
+	labels := splitList(*searchLabels)
+	if len(labels) == 0 {
+		klog.Fatalf("-search-label must list at least one label")
+	}
+
 	reg := prometheus.NewRegistry()
-	foo, err := NewCommitTimeCollector()
+	foo, err := NewCommitTimeCollector(CollectorOptions{
+		SearchLabels:            labels,
+		ImageFilters:            splitList(*imageFilters),
+		ImageExcludes:           splitList(*imageExcludes),
+		PagerdutyServiceIDs:     splitList(*pagerdutyServiceIDs),
+		ScrapeTimeout:           *scrapeTimeout,
+		FailureLookback:         *failureLookback,
+		GithubMinRemainingQuota: *githubMinRemainingQuota,
+		GithubMaxRateLimitWait:  *githubMaxRateLimitWait,
+	})
 	if err != nil {
 		klog.Errorf("can't find the openshift cluster: %s", err)
 		return
@@ -40,5 +63,7 @@ func main() {
 	reg.MustRegister(foo)
 	klog.Info("Running exporters...")
 	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler(foo.kubeClient))
 	log.Fatal(http.ListenAndServe(":9101", nil))
 }
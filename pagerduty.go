@@ -29,12 +29,18 @@
 package main
 
 import (
+	"context"
 	"os"
 
 	"github.com/albarbaro/go-pagerduty"
 	"k8s.io/klog/v2"
 )
 
+// incidentLister is the part of the pagerduty client used by the collector
+type incidentLister interface {
+	ListIncidentsWithContext(ctx context.Context, o pagerduty.ListIncidentsOptions) (*pagerduty.ListIncidentsResponse, error)
+}
+
 func NewPagedutyClient() *pagerduty.Client {
 	key := "PAGERDUTY_API_KEY"
 	authtoken, ok := os.LookupEnv(key)
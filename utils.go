@@ -22,12 +22,17 @@ import (
 	"k8s.io/klog/v2"
 )
 
-// Helper function and regex to extract values from an image URL
-var imageRegex = regexp.MustCompile(`quay.io\/(?P<org>[-a-zA-Z0-9]*)\/(?P<repo>[-a-zA-Z0-9]*)(@sha256)?:(?P<hash>[-a-zA-Z0-9!@#$%^&*()_+\-=\[\]{};':"\\|,.<>\/?]*)`)
+// Helper function and regex to extract values from an image URL: <registry>/<org>/<repo>[@sha256]:<hash>, with any registry host
+var imageRegex = regexp.MustCompile(`^[^/]+\/(?P<org>[-a-zA-Z0-9_.]*)\/(?P<repo>[-a-zA-Z0-9_.]*)(@sha256)?:(?P<hash>[-a-zA-Z0-9!@#$%^&*()_+\-=\[\]{};':"\\|,.<>\/?]*)`)
 
 func reSubMatchMap(r *regexp.Regexp, str string) map[string]string {
 	match := r.FindStringSubmatch(str)
 	subMatchMap := make(map[string]string)
+	// images without a tag or digest don't match: return no fields rather than indexing an empty match
+	if match == nil {
+		klog.V(3).Infof("can't parse image %s", str)
+		return subMatchMap
+	}
 	for i, name := range r.SubexpNames() {
 		if i != 0 {
 			subMatchMap[name] = match[i]
@@ -36,6 +41,18 @@ func reSubMatchMap(r *regexp.Regexp, str string) map[string]string {
 	return subMatchMap
 }
 
+// splitList turns a comma separated flag value into a list, dropping empty entries
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func filterImage(prefixes []string, image string) bool {
 	for _, prefix := range prefixes {
 		if strings.HasPrefix(image, prefix) {
@@ -0,0 +1,70 @@
+//
+// Copyright (c) 2023 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestReSubMatchMap(t *testing.T) {
+	tests := []struct {
+		image string
+		org   string
+		repo  string
+		hash  string
+	}{
+		{"quay.io/redhat-appstudio/build-service:0123456789abcdef", "redhat-appstudio", "build-service", "0123456789abcdef"},
+		{"quay.io/redhat-appstudio/build-service@sha256:0123456789abcdef", "redhat-appstudio", "build-service", "0123456789abcdef"},
+		{"ghcr.io/acme/api_server:0123456789abcdef", "acme", "api_server", "0123456789abcdef"},
+		{"localhost:5000/acme/api:0123456789abcdef", "acme", "api", "0123456789abcdef"},
+		// a short revision is kept as is
+		{"quay.io/redhat-appstudio/build-service:abc12", "redhat-appstudio", "build-service", "abc12"},
+		// an empty revision yields no hash
+		{"quay.io/redhat-appstudio/build-service:", "redhat-appstudio", "build-service", ""},
+		// an untagged image doesn't match at all
+		{"quay.io/redhat-appstudio/build-service", "", "", ""},
+		{"build-service", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			fields := reSubMatchMap(imageRegex, tt.image)
+			if fields["org"] != tt.org || fields["repo"] != tt.repo || fields["hash"] != tt.hash {
+				t.Errorf("expected org %q, repo %q and hash %q, got %v", tt.org, tt.repo, tt.hash, fields)
+			}
+		})
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{"", []string{}},
+		{",", []string{}},
+		{"a", []string{"a"}},
+		{" a , ,b ", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		got := splitList(tt.value)
+		if len(got) != len(tt.expected) {
+			t.Errorf("%q: expected %v, got %v", tt.value, tt.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.expected[i] {
+				t.Errorf("%q: expected %v, got %v", tt.value, tt.expected, got)
+			}
+		}
+	}
+}